@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bufio"
-	"debug/elf"
+	"encoding/json"
 	"fmt"
 	"log"
-	"os/exec"
-	"regexp"
+	"os"
 	"sort"
+	"strings"
 )
 
 type FnType int
@@ -28,15 +27,69 @@ const (
 	SplitLarge
 )
 
+// stripABI0Suffix removes the ".abi0" suffix the gc compiler appends
+// to a runtime symbol's ABI0 wrapper (e.g.
+// "runtime.morestack_noctxt.abi0") in binaries that carry both ABI0
+// and register-ABI wrappers, so morestack name matching doesn't care
+// which wrapper a call happens to resolve to.
+func stripABI0Suffix(name string) string {
+	return strings.TrimSuffix(name, ".abi0")
+}
+
+// isLongMorestack and isShortMorestack recognize the morestack
+// variants a call can target, per a's MorestackSymbols.
+func isLongMorestack(a arch, name string) bool {
+	name = stripABI0Suffix(name)
+	_, long := a.MorestackSymbols()
+	for _, n := range long {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isShortMorestack(a arch, name string) bool {
+	name = stripABI0Suffix(name)
+	short, _ := a.MorestackSymbols()
+	for _, n := range short {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// funcInfo is what's recorded for each function once its body has
+// been fully walked: its stack-split classification, its
+// prologue-derived frame size (frameSize is meaningless unless
+// hasFrame is true -- not every prologue matches a recognized
+// pattern), and its address/size from the symbol table, for callers
+// (JSON output, -diff) that need to identify the function beyond its
+// name.
+type funcInfo struct {
+	typ       FnType
+	frameSize int
+	hasFrame  bool
+	addr      uint64
+	size      uint64
+	// callees holds the names of every function this one is seen
+	// calling (direct calls and tail calls alike), for callers (the
+	// -check callgraph DFS) that need to walk call chains rather
+	// than just this function's own classification.
+	callees []string
+}
+
 type astate struct {
 	seenShort  bool
 	seenLong   bool
 	seenCall   bool
-	funcs      map[string]FnType
+	callees    []string
+	funcs      map[string]funcInfo
 	collisions int64
 }
 
-func (s *astate) recordFunc(fname string) {
+func (s *astate) recordFunc(fname string, frameSize int, hasFrame bool, addr uint64, size uint64) {
 	disp := FnType(Leaf)
 	if s.seenLong {
 		disp = SplitLarge
@@ -45,16 +98,18 @@ func (s *astate) recordFunc(fname string) {
 	} else if s.seenCall {
 		disp = NoSplit
 	}
-	odisp, ok := s.funcs[fname]
+	info := funcInfo{typ: disp, frameSize: frameSize, hasFrame: hasFrame, addr: addr, size: size, callees: s.callees}
+	oinfo, ok := s.funcs[fname]
 	if ok {
 		s.collisions += 1
 		fname = fmt.Sprintf("%s%s%d", fname, "%", s.collisions)
-		if odisp > disp {
-			disp = odisp
+		if oinfo.typ > disp {
+			info.typ = oinfo.typ
 		}
 	}
-	s.funcs[fname] = disp
+	s.funcs[fname] = info
 	s.seenLong, s.seenShort, s.seenCall = false, false, false
+	s.callees = nil
 }
 
 func (s *astate) analyze() (leaves int64, nonsplit int64, shortsplit int64, longsplit int64) {
@@ -62,8 +117,8 @@ func (s *astate) analyze() (leaves int64, nonsplit int64, shortsplit int64, long
 	ns := int64(0)
 	short := int64(0)
 	long := int64(0)
-	for fn, disp := range s.funcs {
-		switch disp {
+	for fn, info := range s.funcs {
+		switch info.typ {
 		case Unknown:
 			log.Fatalf("corrupted funcs table entry at %s", fn)
 		case Leaf:
@@ -83,86 +138,191 @@ func (s *astate) analyze() (leaves int64, nonsplit int64, shortsplit int64, long
 	return
 }
 
-func examineFile(filename string, detail bool) bool {
+// frameHistoBuckets are the frame-size ranges (in bytes) the
+// histogram groups functions into. The boundaries follow the
+// runtime's own stack-guard reasoning: 128 bytes is the small-frame
+// fast path, 4096 is the point at which a function's frame alone
+// starts to threaten the default goroutine stack guard.
+var frameHistoBuckets = []struct {
+	label string
+	lo    int
+	hi    int // inclusive; hi < 0 means "no upper bound"
+}{
+	{"0", 0, 0},
+	{"1-128", 1, 128},
+	{"129-512", 129, 512},
+	{"513-4096", 513, 4096},
+	{">4096", 4097, -1},
+}
 
-	verb(1, "loading ELF for %s", filename)
-	_, eerr := elf.Open(filename)
-	if eerr != nil {
-		warn("%s does not appear to be an ELF file -- ignoring", filename)
-		return false
+// frameHistogram tallies how many functions with a known frame size
+// fall into each bucket of frameHistoBuckets, in bucket order.
+func frameHistogram(funcs map[string]funcInfo) []int {
+	counts := make([]int, len(frameHistoBuckets))
+	for _, info := range funcs {
+		if !info.hasFrame {
+			continue
+		}
+		for i, b := range frameHistoBuckets {
+			if info.frameSize >= b.lo && (b.hi < 0 || info.frameSize <= b.hi) {
+				counts[i]++
+				break
+			}
+		}
 	}
+	return counts
+}
 
-	args := []string{"-d", "--section=.text", "--no-show-raw-insn", filename}
-	cmd := exec.Command("objdump", args...)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	verb(1, "cmd started: objdump %v", args)
-
-	var state astate
-	state.funcs = make(map[string]FnType)
-	curfunc := ""
-	fnstart := regexp.MustCompile(`^\S+\s\<(\S+)\>\:\s*$`)
-	anycallre := regexp.MustCompile(`^\s*\S+:\s+callq(.+)$`)
-	dircallre := regexp.MustCompile(`^\s*\S+\:\s+callq\s+\S+\s+\<(\S+)\>\s*$`)
-	pltjumpre := regexp.MustCompile(`^\s*\S+\:\s+jmpq\s+\S+\s+\<\S+@plt\>\s*$`)
-
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		line := scanner.Text()
-		verb(3, "line is %s", line)
-
-		matched := fnstart.FindStringSubmatch(line)
-		if matched != nil {
-			// Start of new function. Record info for old function.
-			if curfunc != "" {
-				state.recordFunc(curfunc)
+// disassembleFunc decodes the instructions of a function (whose code
+// is the slice code, loaded at address addr), recording into s
+// whether it calls anything, and if so whether the callee is one of
+// the morestack variants. a supplies the architecture-specific
+// decoding.
+func disassembleFunc(s *astate, a arch, code []byte, addr uint64, syms []Sym) {
+	for off := 0; off < len(code); {
+		pc := addr + uint64(off)
+		if length, tgt, ok := a.IsCall(code[off:], pc); ok {
+			s.seenCall = true
+			classifyTarget(s, a, syms, tgt)
+			off += length
+			continue
+		}
+		if length, tgt, ok := a.IsTailCall(code[off:], pc); ok {
+			// An unconditional branch whose target lands inside this
+			// same function is ordinary intra-function control flow
+			// (a loop back-edge, a goto, a switch join) rather than a
+			// tail call, and must not count as a call -- otherwise
+			// any leaf function containing a loop is misclassified
+			// NoSplit.
+			if tgt < addr || tgt >= addr+uint64(len(code)) {
+				s.seenCall = true
+				classifyTarget(s, a, syms, tgt)
 			}
-			curfunc = matched[1]
-			verb(2, "starting function %s", curfunc)
+			off += length
+			continue
 		}
-
-		pltjumpmatch := pltjumpre.FindStringSubmatch(line)
-		if pltjumpmatch != nil {
-			state.seenCall = true
+		if length, ok := a.IsIndirectCall(code[off:]); ok {
+			// Register/memory-operand call: no fixed target to
+			// classify, but it still counts as a call for
+			// FnType purposes.
+			s.seenCall = true
+			off += length
+			continue
 		}
+		length := a.InstLen(code[off:])
+		if length <= 0 {
+			// Can't decode (data in text, or padding); skip a
+			// byte and resync.
+			length = 1
+		}
+		off += length
+	}
+}
 
-		dircallmatch := dircallre.FindStringSubmatch(line)
-		if dircallmatch != nil {
-			tgt := dircallmatch[1]
-			verb(2, ".. direct call to %s", tgt)
-			state.seenCall = true
-			if tgt == "__morestack" {
-				state.seenShort = true
-			} else if tgt == "__morestack_non_split" {
-				state.seenLong = true
-			}
-		} else {
-			anycallmatch := anycallre.FindStringSubmatch(line)
-			if anycallmatch != nil {
-				verb(2, ".. anycall to %s", anycallmatch[1])
-				state.seenCall = true
+// classifyTarget looks up the symbol at address tgt, records it as a
+// callee of the function currently being walked, and, if it's one of
+// a's morestack variants, records the corresponding flag in s.
+func classifyTarget(s *astate, a arch, syms []Sym, tgt uint64) {
+	name, ok := symbolAt(syms, tgt)
+	if !ok {
+		return
+	}
+	s.callees = append(s.callees, name)
+	if isLongMorestack(a, name) {
+		s.seenLong = true
+	} else if isShortMorestack(a, name) {
+		s.seenShort = true
+	}
+}
+
+// analyzeObjFile opens filename, disassembles its functions, and
+// returns the resulting per-function classifications. The caller is
+// responsible for closing the returned objFile once it's done with
+// it (examineFile's DWARF pass, for instance, needs it to stay open).
+func analyzeObjFile(filename string) (*astate, objFile, error) {
+	verb(1, "opening object file %s", filename)
+	of, oerr := openObjFile(filename)
+	if oerr != nil {
+		return nil, nil, oerr
+	}
+
+	a := archFor(of.machine())
+	if a == nil {
+		of.close()
+		return nil, nil, fmt.Errorf("%s: unsupported architecture", filename)
+	}
+
+	textaddr, textbytes, terr := of.text()
+	if terr != nil {
+		of.close()
+		return nil, nil, terr
+	}
+	syms, serr := of.symbols()
+	if serr != nil {
+		of.close()
+		return nil, nil, serr
+	}
+
+	state := &astate{funcs: make(map[string]funcInfo)}
+
+	for i, sym := range syms {
+		if sym.Addr < textaddr {
+			continue
+		}
+		start := sym.Addr - textaddr
+		if start >= uint64(len(textbytes)) {
+			continue
+		}
+		end := start + sym.Size
+		if sym.Size == 0 {
+			// No size info (seen with some Mach-O/PE symbol
+			// tables): run to the next symbol or end of text.
+			if i+1 < len(syms) && syms[i+1].Addr > sym.Addr {
+				end = syms[i+1].Addr - textaddr
+			} else {
+				end = uint64(len(textbytes))
 			}
 		}
+		if end > uint64(len(textbytes)) {
+			end = uint64(len(textbytes))
+		}
+		if end <= start {
+			continue
+		}
+		verb(2, "examining function %s", sym.Name)
+		disassembleFunc(state, a, textbytes[start:end], sym.Addr, syms)
+		frameSize, hasFrame := a.FrameSize(textbytes[start:end])
+		size := sym.Size
+		if size == 0 {
+			size = end - start
+		}
+		state.recordFunc(sym.Name, frameSize, hasFrame, sym.Addr, size)
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+
+	return state, of, nil
+}
+
+func examineFile(filename string, detail bool, format string) bool {
+	state, of, err := analyzeObjFile(filename)
+	if err != nil {
+		warn("%s", err)
+		return false
 	}
+	defer of.close()
 
-	// Final function
-	if curfunc != "" {
-		state.recordFunc(curfunc)
+	if format == "json" {
+		report := newFileReport(filename, state)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+		return true
 	}
 
 	// Post-process
 	leaves, nonsplit, shortsplit, longsplit := state.analyze()
+	histo := frameHistogram(state.funcs)
 
 	// Emit stats
 	fmt.Printf("stats for '%s':\n", filename)
@@ -171,15 +331,24 @@ func examineFile(filename string, detail bool) bool {
 	fmt.Printf("+ morestack functions: %d\n", shortsplit)
 	fmt.Printf("+ morestack_non_split functions: %d\n", longsplit)
 
+	fmt.Printf("\nframe size histogram for '%s':\n", filename)
+	for i, b := range frameHistoBuckets {
+		fmt.Printf("+ %-9s bytes: %d\n", b.label, histo[i])
+	}
+
 	// Now detail
 	if detail {
 		typs := []FnType{Leaf, NoSplit, SplitSmall, SplitLarge}
 		cats := []string{"Leaf", "NoSplit", "MoreStack", "MoreStackNonSplit"}
 		for idx := 0; idx < len(typs); idx++ {
 			fns := []string{}
-			for fn, disp := range state.funcs {
-				if disp == typs[idx] {
-					fns = append(fns, fn)
+			for fn, info := range state.funcs {
+				if info.typ == typs[idx] {
+					if info.hasFrame {
+						fns = append(fns, fmt.Sprintf("%s (frame=%d)", fn, info.frameSize))
+					} else {
+						fns = append(fns, fmt.Sprintf("%s (frame=?)", fn))
+					}
 				}
 			}
 			sort.Strings(fns)
@@ -190,5 +359,58 @@ func examineFile(filename string, detail bool) bool {
 		}
 	}
 
+	examineDWARF(of, filename, fnTypes(state.funcs))
+
 	return true
 }
+
+// fnTypes projects the funcInfo map down to just the FnType
+// classification, for callers (like the DWARF pass) that don't care
+// about frame sizes.
+func fnTypes(funcs map[string]funcInfo) map[string]FnType {
+	out := make(map[string]FnType, len(funcs))
+	for fn, info := range funcs {
+		out[fn] = info.typ
+	}
+	return out
+}
+
+// examineDWARF runs the DWARF sanity-check pass over filename's debug
+// info, if it has any, and reports whatever it finds. A file with no
+// DWARF (stripped, or a format this tool can't read DWARF from at
+// all) is silently skipped, since plenty of legitimate binaries fall
+// into that category.
+func examineDWARF(of objFile, filename string, funcs map[string]FnType) {
+	dw, err := of.dwarfData()
+	if err != nil {
+		verb(1, "no DWARF info for %s: %v", filename, err)
+		return
+	}
+
+	issues, cus, err := analyzeDWARF(dw, funcs)
+	if err != nil {
+		warn("%s: error walking DWARF info: %v", filename, err)
+		return
+	}
+
+	if len(issues) > 0 {
+		fmt.Printf("\nDWARF issues for '%s':\n", filename)
+		for _, issue := range issues {
+			fmt.Printf("%s\n", issue)
+		}
+	}
+
+	fmt.Printf("\nstats by compilation unit for '%s':\n", filename)
+	for _, cu := range cus {
+		fmt.Printf("cu '%s':\n", cu.name)
+		depths := make([]int, 0, len(cu.byDepth))
+		for d := range cu.byDepth {
+			depths = append(depths, d)
+		}
+		sort.Ints(depths)
+		for _, d := range depths {
+			fmt.Printf("  inline depth %d: leaf=%d nosplit=%d morestack=%d morestack_non_split=%d\n",
+				d, cu.byDepth[d][Leaf], cu.byDepth[d][NoSplit], cu.byDepth[d][SplitSmall], cu.byDepth[d][SplitLarge])
+		}
+	}
+}
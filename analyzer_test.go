@@ -0,0 +1,82 @@
+// This is the one round-trip test in the package: build a tiny Go
+// binary and run the real analysis pass over it, rather than testing
+// the decode helpers in isolation. A unit test against canned
+// instruction bytes wouldn't have caught either of the bugs that
+// prompted it -- the .abi0 symbol suffix and the dropped indirect
+// calls only show up against an actual toolchain-built binary.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// buildTestBinary compiles a small program with both a regular
+// stack-growth call chain and an indirect (interface) call, so the
+// resulting binary exercises morestack recognition and the
+// indirect-call path. It skips the test if no go toolchain is
+// available to build with.
+func buildTestBinary(t *testing.T) string {
+	t.Helper()
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go toolchain available to build a test binary")
+	}
+
+	const src = `package main
+
+import "fmt"
+
+type stringer interface{ String() string }
+type greeting struct{}
+
+func (greeting) String() string { return "hi" }
+
+//go:nosplit
+//go:noinline
+func callIndirect(s stringer) string {
+	return s.String()
+}
+
+func main() {
+	fmt.Println(callIndirect(greeting{}))
+}
+`
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(srcPath, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	binPath := filepath.Join(dir, "testbin")
+	cmd := exec.Command(goBin, "build", "-o", binPath, srcPath)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("go build: %v\n%s", err, out)
+	}
+	return binPath
+}
+
+func TestAnalyzeObjFileMorestackAndIndirectCalls(t *testing.T) {
+	bin := buildTestBinary(t)
+
+	state, of, err := analyzeObjFile(bin)
+	if err != nil {
+		t.Fatalf("analyzeObjFile: %v", err)
+	}
+	defer of.close()
+
+	if _, _, shortsplit, _ := state.analyze(); shortsplit == 0 {
+		t.Error("no functions classified SplitSmall -- morestack symbol recognition (likely the .abi0 suffix) is broken")
+	}
+
+	info, ok := state.funcs["main.callIndirect"]
+	if !ok {
+		t.Fatal("main.callIndirect missing from the symbol table")
+	}
+	if info.typ == Leaf {
+		t.Error("main.callIndirect classified Leaf, but its only call is indirect (an interface call) -- it should be NoSplit or better")
+	}
+}
@@ -0,0 +1,557 @@
+// This file provides the per-architecture instruction decoding that
+// analyzer.go needs in order to recognize calls (and tail-call-style
+// branches) to the morestack family of routines. Go's growing set of
+// non-x86 ports, plus gccgo's -fsplit-stack convention, mean the call
+// instruction and its encoding of the branch target differ by ISA; an
+// arch implementation hides that from the rest of the analyzer, the
+// same way cmd/objdump keeps its per-arch disassemblers behind a
+// common interface.
+
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"golang.org/x/arch/arm/armasm"
+	"golang.org/x/arch/arm64/arm64asm"
+	"golang.org/x/arch/ppc64/ppc64asm"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// arch decodes one instruction at a time out of a function's code,
+// classifying it as a direct call, a direct tail-call branch, an
+// indirect call, or none of these.
+type arch interface {
+	// IsCall reports whether the instruction at the start of code
+	// (located at address pc) is a direct call. On success it
+	// returns the instruction's length in bytes and the absolute
+	// address it calls.
+	IsCall(code []byte, pc uint64) (length int, target uint64, ok bool)
+
+	// IsTailCall is like IsCall, but for a direct unconditional
+	// branch used in tail-call position -- e.g. a -fsplit-stack
+	// prologue that jumps straight to __morestack_non_split instead
+	// of calling it.
+	IsTailCall(code []byte, pc uint64) (length int, target uint64, ok bool)
+
+	// InstLen returns the length in bytes of the instruction at the
+	// start of code, for stepping over instructions that are neither
+	// calls nor tail calls.
+	InstLen(code []byte) int
+
+	// IsIndirectCall reports whether the instruction at the start of
+	// code is a call through a register or memory operand -- an
+	// interface method call or closure invocation, which IsCall can't
+	// resolve to a fixed target. It returns the instruction's length
+	// in bytes. Unlike IsCall, there's no target to feed to
+	// classifyTarget, but the caller still needs to know a call
+	// happened: a //go:nosplit function whose only calls are indirect
+	// must not be misclassified Leaf.
+	IsIndirectCall(code []byte) (length int, ok bool)
+
+	// FrameSize scans the prologue of a function (code, starting at
+	// its first instruction) for the stack-pointer adjustment that
+	// reserves its frame, returning the size in bytes. It gives up
+	// and returns ok == false once it finds a direct call (the
+	// prologue is over), fails to decode the next instruction, or has
+	// scanned a fixed number of instructions without a match.
+	FrameSize(code []byte) (size int, ok bool)
+
+	// MorestackSymbols returns the symbol names this architecture's
+	// toolchains use for the morestack family: short is the regular
+	// stack-check routine (gc's runtime.morestack and friends, plus
+	// gccgo's __morestack), long is the oversized-frame routine
+	// gccgo's -fsplit-stack prologues call instead
+	// (__morestack_non_split). Callers should strip any ".abi0"
+	// wrapper suffix from a symbol name before comparing it against
+	// these (see stripABI0Suffix in analyzer.go) -- gc binaries built
+	// with both calling conventions present append that suffix to the
+	// ABI0 wrapper.
+	MorestackSymbols() (short []string, long []string)
+}
+
+// scanPrologue is the common driver behind each arch's FrameSize:
+// walk instructions one at a time via next (which should decode the
+// instruction at the front of code and report how many bytes it
+// consumed, or 0 if it can't decode it), stopping at the first one
+// that yields a frame size, a call (via isCall), or an instruction
+// next can't decode, or after maxInsns instructions.
+func scanPrologue(code []byte, maxInsns int, next func(code []byte) (length int, frameSize int, found bool), isCall func(code []byte) bool) (int, bool) {
+	off := 0
+	for i := 0; i < maxInsns && off < len(code); i++ {
+		if isCall(code[off:]) {
+			return 0, false
+		}
+		length, frameSize, found := next(code[off:])
+		if length <= 0 {
+			return 0, false
+		}
+		if found {
+			return frameSize, true
+		}
+		off += length
+	}
+	return 0, false
+}
+
+// goShortMorestack, gccgoShortMorestack, and gccgoLongMorestack are
+// the morestack routine names emitted by each toolchain family.
+// They're the same across every architecture this tool supports --
+// only the instruction encoding used to call them varies -- so every
+// arch implementation's MorestackSymbols shares them via
+// defaultMorestackSymbols.
+var (
+	goShortMorestack    = []string{"runtime.morestack", "runtime.morestack_noctxt", "runtime.morestackc"}
+	gccgoShortMorestack = []string{"__morestack"}
+	gccgoLongMorestack  = []string{"__morestack_non_split"}
+)
+
+func defaultMorestackSymbols() (short []string, long []string) {
+	short = append(append([]string{}, goShortMorestack...), gccgoShortMorestack...)
+	long = append([]string{}, gccgoLongMorestack...)
+	return short, long
+}
+
+// archFor returns the arch implementation for m, or nil if m isn't
+// one this tool knows how to disassemble.
+func archFor(m machineKind) arch {
+	switch m {
+	case machineAmd64:
+		return x86Arch{mode: 64}
+	case machine386:
+		return x86Arch{mode: 32}
+	case machineArm:
+		return armArch{}
+	case machineArm64:
+		return arm64Arch{}
+	case machinePpc64:
+		return ppc64Arch{order: binary.BigEndian}
+	case machinePpc64le:
+		return ppc64Arch{order: binary.LittleEndian}
+	default:
+		return nil
+	}
+}
+
+//
+// amd64 / 386
+//
+
+type x86Arch struct {
+	mode int
+}
+
+func (a x86Arch) IsCall(code []byte, pc uint64) (int, uint64, bool) {
+	return a.decodeBranch(code, pc, x86asm.CALL)
+}
+
+func (a x86Arch) IsTailCall(code []byte, pc uint64) (int, uint64, bool) {
+	return a.decodeBranch(code, pc, x86asm.JMP)
+}
+
+func (a x86Arch) decodeBranch(code []byte, pc uint64, op x86asm.Op) (int, uint64, bool) {
+	inst, err := x86asm.Decode(code, a.mode)
+	if err != nil || inst.Len == 0 || inst.Op != op {
+		return 0, 0, false
+	}
+	for _, arg := range inst.Args {
+		if arg == nil {
+			break
+		}
+		if rel, ok := arg.(x86asm.Rel); ok {
+			return inst.Len, pc + uint64(inst.Len) + uint64(int64(rel)), true
+		}
+	}
+	return 0, 0, false
+}
+
+func (a x86Arch) InstLen(code []byte) int {
+	inst, err := x86asm.Decode(code, a.mode)
+	if err != nil || inst.Len == 0 {
+		return 1
+	}
+	return inst.Len
+}
+
+func (x86Arch) MorestackSymbols() ([]string, []string) {
+	return defaultMorestackSymbols()
+}
+
+// IsIndirectCall recognizes a CALL whose operand is a register or a
+// memory location -- e.g. "CALL AX" or "CALL (BX)" -- rather than the
+// x86asm.Rel operand decodeBranch requires, which is how Go compiles
+// interface and closure calls.
+func (a x86Arch) IsIndirectCall(code []byte) (int, bool) {
+	inst, err := x86asm.Decode(code, a.mode)
+	if err != nil || inst.Len == 0 || inst.Op != x86asm.CALL {
+		return 0, false
+	}
+	for _, arg := range inst.Args {
+		if arg == nil {
+			break
+		}
+		if _, ok := arg.(x86asm.Rel); ok {
+			return 0, false
+		}
+	}
+	return inst.Len, true
+}
+
+// spReg returns the stack-pointer register for this mode.
+func (a x86Arch) spReg() x86asm.Reg {
+	if a.mode == 32 {
+		return x86asm.ESP
+	}
+	return x86asm.RSP
+}
+
+func (a x86Arch) FrameSize(code []byte) (int, bool) {
+	sp := a.spReg()
+	return scanPrologue(code, 8,
+		func(c []byte) (int, int, bool) {
+			inst, err := x86asm.Decode(c, a.mode)
+			if err != nil || inst.Len == 0 {
+				return 0, 0, false
+			}
+			size, found := x86FrameAdjust(inst, sp)
+			return inst.Len, size, found
+		},
+		func(c []byte) bool {
+			_, _, ok := a.IsCall(c, 0)
+			return ok
+		})
+}
+
+// x86FrameAdjust recognizes the two common forms a gc or gccgo
+// prologue uses to carve a frame out of the stack: a direct
+// "SUB $imm, SP" or the equivalent "LEA -imm(SP), SP".
+func x86FrameAdjust(inst x86asm.Inst, sp x86asm.Reg) (int, bool) {
+	if len(inst.Args) < 2 {
+		return 0, false
+	}
+	reg, ok := inst.Args[0].(x86asm.Reg)
+	if !ok || reg != sp {
+		return 0, false
+	}
+	switch inst.Op {
+	case x86asm.SUB:
+		if imm, ok := inst.Args[1].(x86asm.Imm); ok {
+			return int(imm), true
+		}
+	case x86asm.LEA:
+		if mem, ok := inst.Args[1].(x86asm.Mem); ok && mem.Base == sp && mem.Disp < 0 {
+			return int(-mem.Disp), true
+		}
+	}
+	return 0, false
+}
+
+//
+// arm
+//
+
+type armArch struct{}
+
+func (armArch) IsCall(code []byte, pc uint64) (int, uint64, bool) {
+	return armDecodeBranch(code, pc, armasm.BL)
+}
+
+func (armArch) IsTailCall(code []byte, pc uint64) (int, uint64, bool) {
+	return armDecodeBranch(code, pc, armasm.B)
+}
+
+func armDecodeBranch(code []byte, pc uint64, op armasm.Op) (int, uint64, bool) {
+	inst, err := armasm.Decode(code, armasm.ModeARM)
+	if err != nil || inst.Len == 0 || inst.Op != op {
+		return 0, 0, false
+	}
+	for _, arg := range inst.Args {
+		if arg == nil {
+			break
+		}
+		if rel, ok := arg.(armasm.PCRel); ok {
+			// Classic ARM branch targets are relative to pc+8,
+			// a remnant of the three-stage pipeline.
+			return inst.Len, pc + 8 + uint64(int32(rel)), true
+		}
+	}
+	return 0, 0, false
+}
+
+func (armArch) InstLen(code []byte) int {
+	inst, err := armasm.Decode(code, armasm.ModeARM)
+	if err != nil || inst.Len == 0 {
+		return 4
+	}
+	return inst.Len
+}
+
+func (a armArch) FrameSize(code []byte) (int, bool) {
+	return scanPrologue(code, 8,
+		func(c []byte) (int, int, bool) {
+			inst, err := armasm.Decode(c, armasm.ModeARM)
+			if err != nil || inst.Len == 0 {
+				return 0, 0, false
+			}
+			if inst.Op != armasm.SUB || len(inst.Args) < 3 {
+				return inst.Len, 0, false
+			}
+			rd, ok := inst.Args[0].(armasm.Reg)
+			if !ok || rd != armasm.SP {
+				return inst.Len, 0, false
+			}
+			rn, ok := inst.Args[1].(armasm.Reg)
+			if !ok || rn != armasm.SP {
+				return inst.Len, 0, false
+			}
+			imm, ok := inst.Args[2].(armasm.Imm)
+			if !ok {
+				return inst.Len, 0, false
+			}
+			return inst.Len, int(imm), true
+		},
+		func(c []byte) bool {
+			_, _, ok := a.IsCall(c, 0)
+			return ok
+		})
+}
+
+func (armArch) MorestackSymbols() ([]string, []string) {
+	return defaultMorestackSymbols()
+}
+
+// IsIndirectCall recognizes a "BLX Rm" (branch-and-link to a register
+// target), ARM's form of an interface or closure call.
+func (armArch) IsIndirectCall(code []byte) (int, bool) {
+	inst, err := armasm.Decode(code, armasm.ModeARM)
+	if err != nil || inst.Len == 0 || inst.Op != armasm.BLX {
+		return 0, false
+	}
+	if _, ok := inst.Args[0].(armasm.Reg); !ok {
+		return 0, false
+	}
+	return inst.Len, true
+}
+
+//
+// arm64
+//
+
+type arm64Arch struct{}
+
+func (arm64Arch) IsCall(code []byte, pc uint64) (int, uint64, bool) {
+	return arm64DecodeBranch(code, pc, arm64asm.BL)
+}
+
+func (arm64Arch) IsTailCall(code []byte, pc uint64) (int, uint64, bool) {
+	return arm64DecodeBranch(code, pc, arm64asm.B)
+}
+
+// arm64InstLen is the length in bytes of every arm64 instruction:
+// unlike x86, arm, and ppc64 (which can have variable-length or
+// prefixed encodings), arm64 instructions are always exactly one
+// word, and arm64asm.Inst has no Len field to read instead.
+const arm64InstLen = 4
+
+func arm64DecodeBranch(code []byte, pc uint64, op arm64asm.Op) (int, uint64, bool) {
+	inst, err := arm64asm.Decode(code)
+	if err != nil || inst.Op != op {
+		return 0, 0, false
+	}
+	for _, arg := range inst.Args {
+		if arg == nil {
+			break
+		}
+		if rel, ok := arg.(arm64asm.PCRel); ok {
+			return arm64InstLen, pc + uint64(int64(rel)), true
+		}
+	}
+	return 0, 0, false
+}
+
+func (arm64Arch) InstLen(code []byte) int {
+	if _, err := arm64asm.Decode(code); err != nil {
+		return arm64InstLen
+	}
+	return arm64InstLen
+}
+
+// arm64MemImmOffset extracts the signed immediate offset out of a
+// MemImmediate operand. arm64asm doesn't export that field (it's a
+// lowercase "imm" on the struct), so this parses it back out of the
+// operand's own String() rendering -- e.g. "[SP,#-32]!" -- which is
+// the only place the decoder exposes it.
+func arm64MemImmOffset(m arm64asm.MemImmediate) (int, bool) {
+	s := m.String()
+	i := strings.IndexByte(s, '#')
+	if i < 0 {
+		return 0, false
+	}
+	s = s[i+1:]
+	if j := strings.IndexAny(s, "]!"); j >= 0 {
+		s = s[:j]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func (a arm64Arch) FrameSize(code []byte) (int, bool) {
+	return scanPrologue(code, 8,
+		func(c []byte) (int, int, bool) {
+			inst, err := arm64asm.Decode(c)
+			if err != nil {
+				return 0, 0, false
+			}
+			switch inst.Op {
+			case arm64asm.SUB:
+				if len(inst.Args) < 3 {
+					return arm64InstLen, 0, false
+				}
+				rd, ok := inst.Args[0].(arm64asm.Reg)
+				if !ok || rd != arm64asm.SP {
+					return arm64InstLen, 0, false
+				}
+				rn, ok := inst.Args[1].(arm64asm.Reg)
+				if !ok || rn != arm64asm.SP {
+					return arm64InstLen, 0, false
+				}
+				imm, ok := inst.Args[2].(arm64asm.Imm)
+				if !ok {
+					return arm64InstLen, 0, false
+				}
+				return arm64InstLen, int(imm.Imm), true
+			case arm64asm.STP:
+				// "stp x29, x30, [sp, #-imm]!" is the frame-pointer
+				// prologue Go actually emits: the pre-indexed store
+				// both saves the FP/LR pair and moves SP down by imm
+				// in a single instruction, instead of a separate SUB.
+				if len(inst.Args) < 3 {
+					return arm64InstLen, 0, false
+				}
+				mem, ok := inst.Args[2].(arm64asm.MemImmediate)
+				if !ok || mem.Mode != arm64asm.AddrPreIndex || mem.Base != arm64asm.RegSP(arm64asm.SP) {
+					return arm64InstLen, 0, false
+				}
+				off, ok := arm64MemImmOffset(mem)
+				if !ok || off >= 0 {
+					return arm64InstLen, 0, false
+				}
+				return arm64InstLen, -off, true
+			}
+			return arm64InstLen, 0, false
+		},
+		func(c []byte) bool {
+			_, _, ok := a.IsCall(c, 0)
+			return ok
+		})
+}
+
+func (arm64Arch) MorestackSymbols() ([]string, []string) {
+	return defaultMorestackSymbols()
+}
+
+// IsIndirectCall recognizes a "BLR Rm" (branch-and-link to a
+// register target), arm64's form of an interface or closure call.
+func (arm64Arch) IsIndirectCall(code []byte) (int, bool) {
+	inst, err := arm64asm.Decode(code)
+	if err != nil || inst.Op != arm64asm.BLR {
+		return 0, false
+	}
+	return arm64InstLen, true
+}
+
+//
+// ppc64 / ppc64le
+//
+
+type ppc64Arch struct {
+	order binary.ByteOrder
+}
+
+func (a ppc64Arch) IsCall(code []byte, pc uint64) (int, uint64, bool) {
+	return a.decodeBranch(code, pc, ppc64asm.BL)
+}
+
+func (a ppc64Arch) IsTailCall(code []byte, pc uint64) (int, uint64, bool) {
+	return a.decodeBranch(code, pc, ppc64asm.B)
+}
+
+func (a ppc64Arch) decodeBranch(code []byte, pc uint64, op ppc64asm.Op) (int, uint64, bool) {
+	inst, err := ppc64asm.Decode(code, a.order)
+	if err != nil || inst.Len == 0 || inst.Op != op {
+		return 0, 0, false
+	}
+	for _, arg := range inst.Args {
+		if arg == nil {
+			break
+		}
+		if rel, ok := arg.(ppc64asm.PCRel); ok {
+			return inst.Len, pc + uint64(int64(rel)), true
+		}
+	}
+	return 0, 0, false
+}
+
+func (a ppc64Arch) InstLen(code []byte) int {
+	inst, err := ppc64asm.Decode(code, a.order)
+	if err != nil || inst.Len == 0 {
+		return 4
+	}
+	return inst.Len
+}
+
+// FrameSize recognizes the ppc64 ABI's usual prologue: rather than a
+// separate subtract, the stack-pointer adjustment is folded into a
+// single "stdu r1,-imm(r1)" store-with-update, which pushes the
+// caller's back-chain pointer onto the new frame and moves the stack
+// pointer in one instruction.
+func (a ppc64Arch) FrameSize(code []byte) (int, bool) {
+	return scanPrologue(code, 8,
+		func(c []byte) (int, int, bool) {
+			inst, err := ppc64asm.Decode(c, a.order)
+			if err != nil || inst.Len == 0 {
+				return 0, 0, false
+			}
+			if inst.Op != ppc64asm.STDU || len(inst.Args) < 3 {
+				return inst.Len, 0, false
+			}
+			rs, ok := inst.Args[0].(ppc64asm.Reg)
+			if !ok || rs != ppc64asm.R1 {
+				return inst.Len, 0, false
+			}
+			ra, ok := inst.Args[2].(ppc64asm.Reg)
+			if !ok || ra != ppc64asm.R1 {
+				return inst.Len, 0, false
+			}
+			off, ok := inst.Args[1].(ppc64asm.Offset)
+			if !ok || off >= 0 {
+				return inst.Len, 0, false
+			}
+			return inst.Len, int(-off), true
+		},
+		func(c []byte) bool {
+			_, _, ok := a.IsCall(c, 0)
+			return ok
+		})
+}
+
+func (ppc64Arch) MorestackSymbols() ([]string, []string) {
+	return defaultMorestackSymbols()
+}
+
+// IsIndirectCall recognizes a "BCCTRL" (branch conditional to the
+// count register and link), ppc64's form of an interface or closure
+// call: the target address is loaded into CTR by a preceding
+// instruction this pass doesn't try to track.
+func (a ppc64Arch) IsIndirectCall(code []byte) (int, bool) {
+	inst, err := ppc64asm.Decode(code, a.order)
+	if err != nil || inst.Len == 0 || inst.Op != ppc64asm.BCCTRL {
+		return 0, false
+	}
+	return inst.Len, true
+}
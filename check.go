@@ -0,0 +1,99 @@
+// This file implements -check, a cmd/vet-style mode: instead of just
+// reporting stats, it promotes specific classifications to
+// diagnostics and exits non-zero if any fire, so it can plug into an
+// existing lint pipeline the same way vet does.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Default thresholds for the -check diagnostics; overridable via
+// -check-splitlarge-threshold and -check-leaf-threshold.
+const (
+	defaultSplitLargeThreshold = 700
+	defaultLeafThreshold       = 4096
+)
+
+// checkFile runs the -check diagnostics over filename and returns one
+// "file:symbol: message" string per finding.
+func checkFile(filename string, splitLargeThreshold, leafThreshold int) ([]string, error) {
+	state, of, err := analyzeObjFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer of.close()
+
+	names := make([]string, 0, len(state.funcs))
+	for name := range state.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var findings []string
+	for _, name := range names {
+		info := state.funcs[name]
+
+		if info.typ == SplitLarge && info.hasFrame && info.frameSize < splitLargeThreshold {
+			findings = append(findings, fmt.Sprintf(
+				"%s:%s: classified SplitLarge with frame size %d, below the %d-byte threshold -- likely a mis-applied //go:nosplit or -fno-split-stack propagation",
+				filename, name, info.frameSize, splitLargeThreshold))
+		}
+
+		if info.typ == Leaf && info.hasFrame && info.frameSize > leafThreshold {
+			findings = append(findings, fmt.Sprintf(
+				"%s:%s: leaf function with frame size %d exceeds %d bytes and has no stack-split check -- stack-overflow hazard",
+				filename, name, info.frameSize, leafThreshold))
+		}
+
+		if info.typ == NoSplit && reachesMorestackNonSplit(name, state.funcs) {
+			findings = append(findings, fmt.Sprintf(
+				"%s:%s: nosplit call chain reaches __morestack_non_split without an intervening stack check",
+				filename, name))
+		}
+	}
+
+	return findings, nil
+}
+
+// reachesMorestackNonSplit reports whether root can reach a function
+// classified SplitLarge by following only calls to other NoSplit
+// functions (root itself may be NoSplit or, as the entry point,
+// anything). This is the "nosplit chain" the -check diagnostic (c)
+// is looking for: a sequence of functions that each skip their own
+// stack check, ending at one that had to fall back to the
+// large-frame morestack path.
+func reachesMorestackNonSplit(root string, funcs map[string]funcInfo) bool {
+	visited := make(map[string]bool)
+	var dfs func(name string) bool
+	dfs = func(name string) bool {
+		if visited[name] {
+			return false
+		}
+		visited[name] = true
+		info, ok := funcs[name]
+		if !ok {
+			return false
+		}
+		if info.typ == SplitLarge {
+			return true
+		}
+		if info.typ != NoSplit {
+			return false
+		}
+		for _, callee := range info.callees {
+			if dfs(callee) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, callee := range funcs[root].callees {
+		if dfs(callee) {
+			return true
+		}
+	}
+	return false
+}
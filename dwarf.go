@@ -0,0 +1,192 @@
+// This file implements the DWARF sanity-check pass promised by the
+// package comment in main.go: walk the DIE tree and flag
+// abstract-origin / specification references that don't point where
+// they should, and tally functions by compilation unit and inline
+// depth so the disassembly-derived FnType stats can be broken down
+// the same way.
+
+package main
+
+import (
+	"debug/dwarf"
+	"fmt"
+)
+
+// cuStats tallies, for a single compile unit, how many functions
+// (including inlined instances, bucketed by inline depth) fall into
+// each FnType.
+type cuStats struct {
+	name    string
+	byDepth map[int]map[FnType]int
+}
+
+func newCUStats(name string) *cuStats {
+	return &cuStats{name: name, byDepth: make(map[int]map[FnType]int)}
+}
+
+func (c *cuStats) record(depth int, t FnType) {
+	m, ok := c.byDepth[depth]
+	if !ok {
+		m = make(map[FnType]int)
+		c.byDepth[depth] = m
+	}
+	m[t]++
+}
+
+// dieInfo is the subset of a DIE's fields the checks below need,
+// captured once up front so the rest of the pass doesn't re-walk the
+// dwarf.Reader to ask the same question twice.
+type dieInfo struct {
+	tag       dwarf.Tag
+	name      string
+	hasName   bool
+	origin    dwarf.Offset
+	hasOrigin bool
+	spec      dwarf.Offset
+	hasSpec   bool
+}
+
+// analyzeDWARF walks every compile unit in dw, checking that each
+// DW_TAG_inlined_subroutine's DW_AT_abstract_origin resolves to a
+// concrete subprogram DIE with a matching name, that each
+// DW_TAG_subprogram's DW_AT_specification resolves to a subprogram
+// DIE (its name is not compared), and building a per-CU,
+// per-inline-depth breakdown of FnType using funcs (keyed by function
+// name, as produced by the disassembly pass).
+//
+// It returns one diagnostic string per problem found, plus the
+// per-CU stats table.
+func analyzeDWARF(dw *dwarf.Data, funcs map[string]FnType) ([]string, []*cuStats, error) {
+	dies := make(map[dwarf.Offset]dieInfo)
+
+	r := dw.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry == nil {
+			break
+		}
+		info := dieInfo{tag: entry.Tag}
+		if v, ok := entry.Val(dwarf.AttrName).(string); ok {
+			info.name, info.hasName = v, true
+		}
+		if v, ok := entry.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+			info.origin, info.hasOrigin = v, true
+		}
+		if v, ok := entry.Val(dwarf.AttrSpecification).(dwarf.Offset); ok {
+			info.spec, info.hasSpec = v, true
+		}
+		dies[entry.Offset] = info
+	}
+
+	var issues []string
+	var cus []*cuStats
+
+	// stack tracks, for each currently-open entry that has children,
+	// whether it was an inlined subroutine, so that hitting the
+	// matching terminator (Tag == 0) pops inlineDepth back to where
+	// it was before we descended into it.
+	var stack []bool // true => entry at this level was an inlined subroutine
+
+	r = dw.Reader()
+	var currentCU *cuStats
+	var inlineDepth int
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag == 0 {
+			// Terminator for the nearest still-open entry with
+			// children.
+			if len(stack) > 0 {
+				wasInline := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if wasInline {
+					inlineDepth--
+				}
+			}
+			continue
+		}
+
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			name, _ := entry.Val(dwarf.AttrName).(string)
+			currentCU = newCUStats(name)
+			cus = append(cus, currentCU)
+
+		case dwarf.TagSubprogram:
+			if spec, ok := entry.Val(dwarf.AttrSpecification).(dwarf.Offset); ok {
+				target, ok := dies[spec]
+				if !ok {
+					issues = append(issues, fmt.Sprintf("dangling DW_AT_specification at offset %#x", entry.Offset))
+				} else if target.tag != dwarf.TagSubprogram {
+					issues = append(issues, fmt.Sprintf("DW_AT_specification at offset %#x refers to non-subprogram DIE", entry.Offset))
+				}
+			}
+			if name, ok := entry.Val(dwarf.AttrName).(string); ok && currentCU != nil {
+				if t, ok := funcs[name]; ok {
+					currentCU.record(inlineDepth, t)
+				}
+			}
+
+		case dwarf.TagInlinedSubroutine:
+			inlineDepth++
+			origin, hasOrigin := entry.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+			if !hasOrigin {
+				issues = append(issues, fmt.Sprintf("inlined subroutine at offset %#x has no DW_AT_abstract_origin", entry.Offset))
+				break
+			}
+			target, ok := dies[origin]
+			if !ok {
+				issues = append(issues, fmt.Sprintf("inlined subroutine at offset %#x: dangling abstract origin %#x", entry.Offset, origin))
+				break
+			}
+			if target.hasOrigin || target.hasSpec {
+				// The origin itself points somewhere else again;
+				// a chain here (rather than a single hop to a
+				// concrete subprogram) almost always indicates a
+				// cycle or a miscompiled CU.
+				issues = append(issues, fmt.Sprintf("inlined subroutine at offset %#x: abstract origin %#x is not a concrete subprogram DIE", entry.Offset, origin))
+				break
+			}
+			if target.tag != dwarf.TagSubprogram {
+				issues = append(issues, fmt.Sprintf("inlined subroutine at offset %#x: abstract origin %#x is not a subprogram (tag %v)", entry.Offset, origin, target.tag))
+				break
+			}
+			if name, ok := entry.Val(dwarf.AttrName).(string); ok && target.hasName && name != target.name {
+				issues = append(issues, fmt.Sprintf("inlined subroutine at offset %#x: name %q disagrees with abstract origin name %q", entry.Offset, name, target.name))
+			}
+			if target.hasName {
+				if t, ok := funcs[target.name]; ok && currentCU != nil {
+					currentCU.record(inlineDepth, t)
+				}
+			}
+		}
+
+		if entry.Tag == dwarf.TagInlinedSubroutine && !entry.Children {
+			// A childless inlined subroutine has no terminator
+			// coming to pop the stack below, so nothing would ever
+			// undo the inlineDepth++ above; undo it here instead, or
+			// every sibling after it would be counted one level too
+			// deep.
+			inlineDepth--
+		}
+
+		if entry.Children {
+			// This entry's children come next in the reader's
+			// preorder traversal, terminated by a Tag == 0 entry
+			// handled above; just remember what kind of entry we
+			// descended into so the terminator can undo its effect
+			// on inlineDepth.
+			stack = append(stack, entry.Tag == dwarf.TagInlinedSubroutine)
+		}
+	}
+
+	return issues, cus, nil
+}
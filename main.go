@@ -15,6 +15,11 @@ import (
 
 var verbflag = flag.Int("v", 0, "Verbose trace output level")
 var detailflag = flag.Bool("detail", false, "Show names of funcs in each category")
+var formatflag = flag.String("format", "text", "Output format: text or json")
+var diffflag = flag.Bool("diff", false, "Diff mode: compare stack-split stats between two object files")
+var checkflag = flag.Bool("check", false, "Check mode: flag suspicious classifications and exit 1 if any are found")
+var checkSplitLargeThreshold = flag.Int("check-splitlarge-threshold", defaultSplitLargeThreshold, "Frame size (bytes) below which a SplitLarge function is flagged by -check")
+var checkLeafThreshold = flag.Int("check-leaf-threshold", defaultLeafThreshold, "Frame size (bytes) above which a leaf function is flagged by -check")
 
 func verb(vlevel int, s string, a ...interface{}) {
 	if *verbflag >= vlevel {
@@ -42,11 +47,49 @@ func main() {
 	log.SetPrefix("analyze-stacksplit: ")
 	flag.Parse()
 	verb(1, "in main")
+
+	if *diffflag {
+		if flag.NArg() != 2 {
+			usage("-diff requires exactly two object files (old, new)")
+		}
+		if diffFiles(flag.Arg(0), flag.Arg(1)) {
+			os.Exit(1)
+		}
+		verb(1, "leaving main")
+		return
+	}
+
+	if *checkflag {
+		if flag.NArg() == 0 {
+			usage("please supply one or more object files as command line arguments")
+		}
+		found := false
+		for _, arg := range flag.Args() {
+			findings, err := checkFile(arg, *checkSplitLargeThreshold, *checkLeafThreshold)
+			if err != nil {
+				warn("%s", err)
+				continue
+			}
+			for _, f := range findings {
+				fmt.Println(f)
+				found = true
+			}
+		}
+		if found {
+			os.Exit(1)
+		}
+		verb(1, "leaving main")
+		return
+	}
+
+	if *formatflag != "text" && *formatflag != "json" {
+		usage(fmt.Sprintf("unknown -format %q: want text or json", *formatflag))
+	}
 	if flag.NArg() == 0 {
-		usage("please supply one or more ELF files as command line arguments")
+		usage("please supply one or more object files as command line arguments")
 	}
 	for _, arg := range flag.Args() {
-		examineFile(arg, *detailflag)
+		examineFile(arg, *detailflag, *formatflag)
 	}
 	verb(1, "leaving main")
 }
@@ -0,0 +1,334 @@
+// This file implements a small multi-format object-file abstraction,
+// modeled after the one used by cmd/objdump and cmd/internal/objfile:
+// enough to hand back the bytes of the text section plus a symbol
+// table, without dragging in the full weight of those internal
+// packages (which aren't importable from outside the standard
+// library).
+
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"debug/plan9obj"
+	"fmt"
+	"sort"
+)
+
+// Sym is a minimal symbol-table entry: enough to know where a
+// function starts, how big it is, and what it's called.
+type Sym struct {
+	Name string
+	Addr uint64
+	Size uint64
+}
+
+// objFile abstracts over the handful of executable formats Go
+// toolchains produce, so the disassembly pass above it doesn't need
+// to know whether it's looking at an ELF, a Mach-O, a PE, or a
+// plan9obj file.
+type objFile interface {
+	// machine returns the architecture for dispatch to an arch
+	// implementation (see arch.go).
+	machine() machineKind
+
+	// text returns the load address and raw bytes of the
+	// executable text section.
+	text() (addr uint64, bytes []byte, err error)
+
+	// symbols returns the file's symbols, sorted by address. ELF and
+	// plan9obj tables hold only function (text) symbols; Mach-O and
+	// PE tables hold every defined symbol, data included.
+	symbols() ([]Sym, error)
+
+	// dwarfData returns the file's DWARF debug info, if present.
+	dwarfData() (*dwarf.Data, error)
+
+	close() error
+}
+
+// machineKind identifies the instruction set of an objFile,
+// independent of the container format it came from.
+type machineKind int
+
+const (
+	machineUnknown machineKind = iota
+	machineAmd64
+	machine386
+	machineArm
+	machineArm64
+	machinePpc64
+	machinePpc64le
+)
+
+// openObjFile sniffs filename and returns the appropriate objFile
+// implementation. It tries each supported container format in turn;
+// this mirrors the approach taken by debug/*'s own Open functions,
+// none of which can be asked "is this your format?" without erroring.
+func openObjFile(filename string) (objFile, error) {
+	if f, err := elf.Open(filename); err == nil {
+		return &elfObjFile{f: f}, nil
+	}
+	if f, err := macho.Open(filename); err == nil {
+		return &machoObjFile{f: f}, nil
+	}
+	if f, err := pe.Open(filename); err == nil {
+		return &peObjFile{f: f}, nil
+	}
+	if f, err := plan9obj.Open(filename); err == nil {
+		return &plan9ObjFile{f: f}, nil
+	}
+	return nil, fmt.Errorf("%s: unrecognized object file format", filename)
+}
+
+//
+// ELF
+//
+
+type elfObjFile struct {
+	f *elf.File
+}
+
+func (o *elfObjFile) machine() machineKind {
+	switch o.f.Machine {
+	case elf.EM_X86_64:
+		return machineAmd64
+	case elf.EM_386:
+		return machine386
+	case elf.EM_ARM:
+		return machineArm
+	case elf.EM_AARCH64:
+		return machineArm64
+	case elf.EM_PPC64:
+		if o.f.ByteOrder.String() == "LittleEndian" {
+			return machinePpc64le
+		}
+		return machinePpc64
+	default:
+		return machineUnknown
+	}
+}
+
+func (o *elfObjFile) text() (uint64, []byte, error) {
+	sect := o.f.Section(".text")
+	if sect == nil {
+		return 0, nil, fmt.Errorf("no .text section")
+	}
+	data, err := sect.Data()
+	if err != nil {
+		return 0, nil, err
+	}
+	return sect.Addr, data, nil
+}
+
+func (o *elfObjFile) symbols() ([]Sym, error) {
+	syms, err := o.f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	var out []Sym
+	for _, s := range syms {
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Size == 0 {
+			continue
+		}
+		out = append(out, Sym{Name: s.Name, Addr: s.Value, Size: s.Size})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out, nil
+}
+
+func (o *elfObjFile) dwarfData() (*dwarf.Data, error) { return o.f.DWARF() }
+
+func (o *elfObjFile) close() error { return o.f.Close() }
+
+//
+// Mach-O
+//
+
+type machoObjFile struct {
+	f *macho.File
+}
+
+func (o *machoObjFile) machine() machineKind {
+	switch o.f.Cpu {
+	case macho.CpuAmd64:
+		return machineAmd64
+	case macho.Cpu386:
+		return machine386
+	case macho.CpuArm64:
+		return machineArm64
+	case macho.CpuArm:
+		return machineArm
+	default:
+		return machineUnknown
+	}
+}
+
+func (o *machoObjFile) text() (uint64, []byte, error) {
+	sect := o.f.Section("__text")
+	if sect == nil {
+		return 0, nil, fmt.Errorf("no __text section")
+	}
+	data, err := sect.Data()
+	if err != nil {
+		return 0, nil, err
+	}
+	return sect.Addr, data, nil
+}
+
+func (o *machoObjFile) symbols() ([]Sym, error) {
+	if o.f.Symtab == nil {
+		return nil, fmt.Errorf("no symbol table")
+	}
+	var out []Sym
+	for _, s := range o.f.Symtab.Syms {
+		if s.Value == 0 || s.Name == "" {
+			continue
+		}
+		out = append(out, Sym{Name: s.Name, Addr: s.Value})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	// Mach-O symbol tables don't carry sizes; approximate each
+	// symbol's size as the gap to the next one.
+	for i := range out {
+		if i+1 < len(out) {
+			out[i].Size = out[i+1].Addr - out[i].Addr
+		}
+	}
+	return out, nil
+}
+
+func (o *machoObjFile) dwarfData() (*dwarf.Data, error) { return o.f.DWARF() }
+
+func (o *machoObjFile) close() error { return o.f.Close() }
+
+//
+// PE
+//
+
+type peObjFile struct {
+	f *pe.File
+}
+
+func (o *peObjFile) machine() machineKind {
+	switch o.f.Machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return machineAmd64
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return machine386
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return machineArm64
+	case pe.IMAGE_FILE_MACHINE_ARMNT:
+		return machineArm
+	default:
+		return machineUnknown
+	}
+}
+
+func (o *peObjFile) text() (uint64, []byte, error) {
+	sect := o.f.Section(".text")
+	if sect == nil {
+		return 0, nil, fmt.Errorf("no .text section")
+	}
+	data, err := sect.Data()
+	if err != nil {
+		return 0, nil, err
+	}
+	return uint64(sect.VirtualAddress), data, nil
+}
+
+func (o *peObjFile) symbols() ([]Sym, error) {
+	var out []Sym
+	for _, s := range o.f.Symbols {
+		if s.SectionNumber <= 0 || int(s.SectionNumber) > len(o.f.Sections) {
+			continue
+		}
+		// s.Value is an offset within the symbol's section; add the
+		// section's address so it's comparable with text()'s.
+		sect := o.f.Sections[s.SectionNumber-1]
+		out = append(out, Sym{Name: s.Name, Addr: uint64(sect.VirtualAddress) + uint64(s.Value)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	for i := range out {
+		if i+1 < len(out) {
+			out[i].Size = out[i+1].Addr - out[i].Addr
+		}
+	}
+	return out, nil
+}
+
+func (o *peObjFile) dwarfData() (*dwarf.Data, error) { return o.f.DWARF() }
+
+func (o *peObjFile) close() error { return o.f.Close() }
+
+//
+// plan9obj
+//
+
+type plan9ObjFile struct {
+	f *plan9obj.File
+}
+
+func (o *plan9ObjFile) machine() machineKind {
+	switch o.f.Magic {
+	case plan9obj.MagicAMD64:
+		return machineAmd64
+	default:
+		return machineUnknown
+	}
+}
+
+func (o *plan9ObjFile) text() (uint64, []byte, error) {
+	sect := o.f.Section("text")
+	if sect == nil {
+		return 0, nil, fmt.Errorf("no text section")
+	}
+	data, err := sect.Data()
+	if err != nil {
+		return 0, nil, err
+	}
+	return o.f.LoadAddress + o.f.HdrSize, data, nil
+}
+
+func (o *plan9ObjFile) symbols() ([]Sym, error) {
+	syms, err := o.f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	var out []Sym
+	for _, s := range syms {
+		if s.Type != 'T' && s.Type != 't' {
+			continue
+		}
+		out = append(out, Sym{Name: s.Name, Addr: s.Value})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	for i := range out {
+		if i+1 < len(out) {
+			out[i].Size = out[i+1].Addr - out[i].Addr
+		}
+	}
+	return out, nil
+}
+
+func (o *plan9ObjFile) dwarfData() (*dwarf.Data, error) {
+	return nil, fmt.Errorf("DWARF info not supported for plan9obj files")
+}
+
+func (o *plan9ObjFile) close() error { return nil }
+
+// symbolAt returns the name of the symbol containing addr, if any.
+// syms must be sorted by address (as returned by objFile.symbols).
+func symbolAt(syms []Sym, addr uint64) (string, bool) {
+	i := sort.Search(len(syms), func(i int) bool { return syms[i].Addr > addr })
+	if i == 0 {
+		return "", false
+	}
+	s := syms[i-1]
+	if s.Size != 0 && addr >= s.Addr+s.Size {
+		return "", false
+	}
+	return s.Name, true
+}
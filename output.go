@@ -0,0 +1,140 @@
+// This file implements the -format=json output and the -diff mode
+// built on top of it: a JSON rendering of a single file's stats plus
+// per-function detail, and a comparison of that rendering across two
+// binaries so a CI job can flag functions whose classification or
+// frame size regressed.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// counts mirrors the leaf/nosplit/morestack/morestack_non_split
+// tallies already printed in text mode.
+type counts struct {
+	Leaf    int `json:"leaf"`
+	NoSplit int `json:"nosplit"`
+	Short   int `json:"short"`
+	Long    int `json:"long"`
+}
+
+// funcReport is one function's entry in a fileReport.
+type funcReport struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	FrameSize int    `json:"frameSize,omitempty"`
+	Addr      uint64 `json:"addr"`
+	Size      uint64 `json:"size"`
+}
+
+// fileReport is the top-level -format=json schema for a single
+// binary: {file, counts, functions}.
+type fileReport struct {
+	File      string       `json:"file"`
+	Counts    counts       `json:"counts"`
+	Functions []funcReport `json:"functions"`
+}
+
+func fnTypeName(t FnType) string {
+	switch t {
+	case Leaf:
+		return "Leaf"
+	case NoSplit:
+		return "NoSplit"
+	case SplitSmall:
+		return "SplitSmall"
+	case SplitLarge:
+		return "SplitLarge"
+	default:
+		return "Unknown"
+	}
+}
+
+// newFileReport converts an astate (as produced by analyzeObjFile)
+// into the JSON-serializable fileReport for filename.
+func newFileReport(filename string, state *astate) *fileReport {
+	leaves, nonsplit, shortsplit, longsplit := state.analyze()
+	report := &fileReport{
+		File: filename,
+		Counts: counts{
+			Leaf:    int(leaves),
+			NoSplit: int(nonsplit),
+			Short:   int(shortsplit),
+			Long:    int(longsplit),
+		},
+	}
+	names := make([]string, 0, len(state.funcs))
+	for name := range state.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := state.funcs[name]
+		fr := funcReport{
+			Name: name,
+			Type: fnTypeName(info.typ),
+			Addr: info.addr,
+			Size: info.size,
+		}
+		if info.hasFrame {
+			fr.FrameSize = info.frameSize
+		}
+		report.Functions = append(report.Functions, fr)
+	}
+	return report
+}
+
+// diffFiles analyzes oldfile and newfile, joins their functions by
+// name, and reports those whose FnType or frame size changed, plus
+// those present in only one of the two files. It returns true if it
+// found any such functions, so -diff can use it to
+// set the process exit status the way a CI gate would expect.
+func diffFiles(oldfile, newfile string) bool {
+	oldState, oldObj, err := analyzeObjFile(oldfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer oldObj.close()
+	newState, newObj, err := analyzeObjFile(newfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer newObj.close()
+
+	names := make(map[string]bool)
+	for name := range oldState.funcs {
+		names[name] = true
+	}
+	for name := range newState.funcs {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	changed := false
+	for _, name := range sorted {
+		oinfo, oldok := oldState.funcs[name]
+		ninfo, newok := newState.funcs[name]
+		switch {
+		case oldok && !newok:
+			fmt.Printf("%s: removed (was %s)\n", name, fnTypeName(oinfo.typ))
+			changed = true
+		case !oldok && newok:
+			fmt.Printf("%s: added (%s)\n", name, fnTypeName(ninfo.typ))
+			changed = true
+		case oinfo.typ != ninfo.typ:
+			fmt.Printf("%s: %s -> %s\n", name, fnTypeName(oinfo.typ), fnTypeName(ninfo.typ))
+			changed = true
+		case oinfo.hasFrame && ninfo.hasFrame && oinfo.frameSize != ninfo.frameSize:
+			fmt.Printf("%s: frame size %d -> %d\n", name, oinfo.frameSize, ninfo.frameSize)
+			changed = true
+		}
+	}
+	return changed
+}